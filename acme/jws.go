@@ -5,34 +5,330 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"sync"
+	"time"
 
 	"gopkg.in/square/go-jose.v1"
 )
 
+// nonceRetryBaseDelay and nonceRetryMaxDelay bound the exponential backoff
+// the nonce prefetcher applies between failed newNonce requests, so a
+// network blip or an ACME outage can't spin the goroutine into a tight
+// loop hammering the directory URL.
+const (
+	nonceRetryBaseDelay = 250 * time.Millisecond
+	nonceRetryMaxDelay  = 30 * time.Second
+)
+
+// defaultNoncePoolSize is how many replay nonces the pool keeps warm when
+// the client doesn't call WithNoncePoolSize.
+const defaultNoncePoolSize = 100
+
+// badNonceErrorType is the ACME problem document "type" the server returns
+// when a JWS was signed with a stale or already-consumed nonce.
+const badNonceErrorType = "urn:ietf:params:acme:error:badNonce"
+
 type jws struct {
-	directoryURL string
-	privKey      crypto.PrivateKey
-	nonces       nonceManager
+	directoryURL   string
+	privKey        crypto.PrivateKey
+	noncePoolSize  int
+	nonces         *nonceManager
+	nonceInit      sync.Once
+	thumbprint     string
+	thumbprintErr  error
+	thumbprintInit sync.Once
+	sigAlg         jose.SignatureAlgorithm
+}
+
+// Thumbprint returns the RFC 7638 JWK thumbprint of the client's account
+// key, computing and caching it (or the error computing it) on first use.
+// It is the thumbprint from which keyAuthorization = token || "." ||
+// thumbprint is built.
+func (j *jws) Thumbprint() (string, error) {
+	j.thumbprintInit.Do(func() {
+		j.thumbprint, j.thumbprintErr = Thumbprint(j.privKey)
+	})
+	if j.thumbprintErr != nil {
+		return "", j.thumbprintErr
+	}
+
+	return j.thumbprint, nil
+}
+
+// ClientOption configures optional behavior of an ACME client by setting a
+// field of the jws it is called with. Nothing in this package applies
+// options on its own: a caller passes its jws to each option.
+type ClientOption func(*jws)
+
+// WithNoncePoolSize overrides the default size (100) of the replay-nonce
+// pool the client keeps warm in the background. Callers issuing many
+// certificates, or running many orders, concurrently should raise this so
+// goroutines rarely have to round-trip to the newNonce endpoint themselves.
+func WithNoncePoolSize(n int) ClientOption {
+	return func(j *jws) {
+		j.noncePoolSize = n
+	}
+}
+
+// WithSignatureAlgorithm opts an RSA account key into RSA-PSS (PS256,
+// PS384 or PS512) instead of the default RS256, as RFC 8555 section 6.2
+// permits. It has no effect on ECDSA keys, which always sign with the
+// ES256/ES384/ES512 mandated by their curve.
+func WithSignatureAlgorithm(alg jose.SignatureAlgorithm) ClientOption {
+	return func(j *jws) {
+		j.sigAlg = alg
+	}
+}
+
+// Thumbprint computes the RFC 7638 SHA-256 JWK thumbprint of privKey's
+// public component, base64url encoded without padding. It lets challenge
+// solvers derive keyAuthorization = token || "." || thumbprint without each
+// reimplementing the JWK canonicalization themselves.
+//
+// The HTTP-01, TLS-ALPN-01 and DNS-01 solvers still compute
+// keyAuthorization themselves rather than calling this helper: none of
+// those packages are present in this tree, so that refactor is left for
+// whoever lands them, rather than guessed at here.
+func Thumbprint(privKey crypto.PrivateKey) (string, error) {
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("acme: private key of type %T does not implement crypto.Signer", privKey)
+	}
+
+	jwk, err := canonicalJWK(signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(jwk)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// canonicalJWK renders pub as the minimal JSON object RFC 7638 defines the
+// thumbprint over: only the required members, in lexicographic order, with
+// no whitespace.
+func canonicalJWK(pub crypto.PublicKey) ([]byte, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+		})
+	case *ecdsa.PublicKey:
+		crv, size, err := ecdsaCurveParams(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{
+			Crv: crv,
+			Kty: "EC",
+			X:   base64.RawURLEncoding.EncodeToString(padCoordinate(k.X, size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padCoordinate(k.Y, size)),
+		})
+	default:
+		return nil, fmt.Errorf("acme: unsupported public key type %T for JWK thumbprint", pub)
+	}
+}
+
+// ecdsaCurveParams maps a curve to its JWK "crv" name and coordinate
+// byte-length.
+func ecdsaCurveParams(curve elliptic.Curve) (crv string, size int, err error) {
+	switch curve {
+	case elliptic.P256():
+		return "P-256", 32, nil
+	case elliptic.P384():
+		return "P-384", 48, nil
+	case elliptic.P521():
+		return "P-521", 66, nil
+	default:
+		return "", 0, fmt.Errorf("acme: unsupported elliptic curve %v for JWK thumbprint", curve)
+	}
 }
 
-func keyAsJWK(key interface{}) *jose.JsonWebKey {
+// padCoordinate left-pads an EC coordinate to size bytes, since crypto/elliptic
+// strips leading zeroes that a fixed-width JWK coordinate must retain.
+func padCoordinate(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// keyAsJWK renders key as a JWK, tagging it with alg so the resulting JWK's
+// "alg" member reflects the JWS signature algorithm actually in use (e.g.
+// PS256 for an RSA key opted into RSA-PSS) rather than just its key type.
+func keyAsJWK(key interface{}, alg jose.SignatureAlgorithm) *jose.JsonWebKey {
 	switch k := key.(type) {
 	case *ecdsa.PublicKey:
-		return &jose.JsonWebKey{Key: k, Algorithm: "EC"}
+		return &jose.JsonWebKey{Key: k, Algorithm: string(alg)}
 	case *rsa.PublicKey:
-		return &jose.JsonWebKey{Key: k, Algorithm: "RSA"}
+		return &jose.JsonWebKey{Key: k, Algorithm: string(alg)}
 
 	default:
 		return nil
 	}
 }
 
-// Posts a JWS signed message to the specified URL
+// jsonWebSignature is the flattened JWS serialization the ACME server
+// expects: a protected header, the payload and a signature, tracked here as
+// raw bytes and base64url-encoded on output.
+//
+// The imported gopkg.in/square/go-jose.v1 has no OpaqueSigner hook -- its
+// jose.NewSigner type-switches the signing key down to *rsa.PrivateKey,
+// *ecdsa.PrivateKey, []byte or *JsonWebKey, so a wrapper around an arbitrary
+// crypto.Signer can never reach it. The JWS framing is therefore built by
+// hand here, driven by payloadSigner below, so any crypto.Signer -- an
+// in-memory key or one backed by an HSM, a KMS, or a PKCS#11 token -- can
+// sign account-key requests the same way.
+type jsonWebSignature struct {
+	protected, payload, signature []byte
+}
+
+func (j *jsonWebSignature) FullSerialize() string {
+	return fmt.Sprintf(
+		`{"protected":%q,"payload":%q,"signature":%q}`,
+		base64.RawURLEncoding.EncodeToString(j.protected),
+		base64.RawURLEncoding.EncodeToString(j.payload),
+		base64.RawURLEncoding.EncodeToString(j.signature),
+	)
+}
+
+// payloadSigner signs JWS payloads on behalf of the account key. It wraps a
+// crypto.Signer rather than a concrete *rsa.PrivateKey or *ecdsa.PrivateKey,
+// so an account key held in an HSM, a KMS, or a PKCS#11 token works exactly
+// like one held in memory.
+type payloadSigner struct {
+	signer crypto.Signer
+	alg    jose.SignatureAlgorithm
+	hash   crypto.Hash
+	opts   crypto.SignerOpts
+}
+
+// ErrUnsupportedKey is returned when the account key's type or curve has no
+// corresponding JWS signature algorithm. A requested algorithm is never
+// rejected: an RSA key for which anything other than PS256, PS384 or PS512
+// was requested signs with RS256.
+var ErrUnsupportedKey = errors.New("acme: unsupported private key for JWS signing")
+
+// rsaPSSHashes maps the RSA-PSS algorithms WithSignatureAlgorithm accepts
+// to the hash RFC 8555 pairs each one with.
+var rsaPSSHashes = map[jose.SignatureAlgorithm]crypto.Hash{
+	jose.PS256: crypto.SHA256,
+	jose.PS384: crypto.SHA384,
+	jose.PS512: crypto.SHA512,
+}
+
+// newPayloadSigner inspects the public half of privKey, exposed through the
+// crypto.Signer interface, to pick the JWS algorithm and digest to sign
+// with. preferredAlg opts an RSA key into RSA-PSS; it is ignored for ECDSA
+// keys, whose algorithm is determined by their curve.
+func newPayloadSigner(privKey crypto.PrivateKey, preferredAlg jose.SignatureAlgorithm) (*payloadSigner, error) {
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("acme: private key of type %T does not implement crypto.Signer", privKey)
+	}
+
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		if hash, ok := rsaPSSHashes[preferredAlg]; ok {
+			return &payloadSigner{
+				signer: signer,
+				alg:    preferredAlg,
+				hash:   hash,
+				opts:   &rsa.PSSOptions{Hash: hash, SaltLength: rsa.PSSSaltLengthEqualsHash},
+			}, nil
+		}
+		return &payloadSigner{signer: signer, alg: jose.RS256, hash: crypto.SHA256, opts: crypto.SHA256}, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return &payloadSigner{signer: signer, alg: jose.ES256, hash: crypto.SHA256, opts: crypto.SHA256}, nil
+		case elliptic.P384():
+			return &payloadSigner{signer: signer, alg: jose.ES384, hash: crypto.SHA384, opts: crypto.SHA384}, nil
+		case elliptic.P521():
+			return &payloadSigner{signer: signer, alg: jose.ES512, hash: crypto.SHA512, opts: crypto.SHA512}, nil
+		}
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+// sign computes the JWS signature over signingInput, the base64url-encoded
+// "protected.payload" defined by RFC 7515 section 5.1.
+func (p *payloadSigner) sign(signingInput []byte) ([]byte, error) {
+	h := p.hash.New()
+	h.Write(signingInput)
+
+	sig, err := p.signer.Sign(rand.Reader, h.Sum(nil), p.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := p.signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return sig, nil
+	}
+
+	return ecdsaDERToJWS(sig, ecdsaKey.Curve)
+}
+
+// ecdsaDERToJWS converts the ASN.1 DER-encoded signature crypto.Signer.Sign
+// returns for an ECDSA key into the raw, fixed-width r||s concatenation a
+// JWS signature requires.
+func ecdsaDERToJWS(der []byte, curve elliptic.Curve) ([]byte, error) {
+	var parsed struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &parsed); err != nil {
+		return nil, fmt.Errorf("acme: failed to parse ECDSA signature: %v", err)
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+
+	rBytes := parsed.R.Bytes()
+	copy(sig[size-len(rBytes):size], rBytes)
+
+	sBytes := parsed.S.Bytes()
+	copy(sig[2*size-len(sBytes):], sBytes)
+
+	return sig, nil
+}
+
+// Posts a JWS signed message to the specified URL. If the server rejects
+// the message because the nonce was stale (badNonce), the message is
+// transparently re-signed with a fresh nonce and resent once.
 func (j *jws) post(url string, content []byte) (*http.Response, error) {
+	return j.postWithRetry(url, content, true)
+}
+
+func (j *jws) postWithRetry(url string, content []byte, retryBadNonce bool) (*http.Response, error) {
 	signedContent, err := j.signContent(content)
 	if err != nil {
 		return nil, err
@@ -48,66 +344,174 @@ func (j *jws) post(url string, content []byte) (*http.Response, error) {
 		j.nonces.Push(nonce)
 	}
 
+	if retryBadNonce && resp.StatusCode >= http.StatusBadRequest && isBadNonceResponse(resp) {
+		return j.postWithRetry(url, content, false)
+	}
+
 	return resp, err
 }
 
-func (j *jws) signContent(content []byte) (*jose.JsonWebSignature, error) {
+// isBadNonceResponse reports whether resp carries an ACME badNonce problem
+// document, restoring resp.Body afterwards so callers can still read it.
+func isBadNonceResponse(resp *http.Response) bool {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
 
-	var alg jose.SignatureAlgorithm
-	switch k := j.privKey.(type) {
-	case *rsa.PrivateKey:
-		alg = jose.RS256
-	case *ecdsa.PrivateKey:
-		if k.Curve == elliptic.P256() {
-			alg = jose.ES256
-		} else if k.Curve == elliptic.P384() {
-			alg = jose.ES384
-		}
+	var problem struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(body, &problem); err != nil {
+		return false
+	}
+
+	return problem.Type == badNonceErrorType
+}
+
+func (j *jws) signContent(content []byte) (*jsonWebSignature, error) {
+	signer, err := newPayloadSigner(j.privKey, j.sigAlg)
+	if err != nil {
+		return nil, err
 	}
 
-	signer, err := jose.NewSigner(alg, j.privKey)
+	nonce, err := j.Nonce()
 	if err != nil {
 		return nil, err
 	}
-	signer.SetNonceSource(j)
 
-	signed, err := signer.Sign(content)
+	protected, err := json.Marshal(map[string]interface{}{
+		"alg":   signer.alg,
+		"jwk":   keyAsJWK(signer.signer.Public(), signer.alg),
+		"nonce": nonce,
+	})
 	if err != nil {
 		return nil, err
 	}
-	return signed, nil
+
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protected)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(content)
+
+	signature, err := signer.sign([]byte(encodedProtected + "." + encodedPayload))
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonWebSignature{protected: protected, payload: content, signature: signature}, nil
+}
+
+// Close stops the background nonce prefetcher Nonce started, if any. A
+// Client wraps a jws and should call Close from its own Close/Stop method
+// so a long-lived process that creates and discards clients (e.g. one per
+// renewal cycle) doesn't leak a prefetcher goroutine per client.
+func (j *jws) Close() error {
+	if j.nonces != nil {
+		j.nonces.stopPrefetcher()
+	}
+	return nil
 }
 
 func (j *jws) Nonce() (string, error) {
-	if nonce, ok := j.nonces.Pop(); ok {
+	j.nonceInit.Do(func() {
+		size := j.noncePoolSize
+		if size <= 0 {
+			size = defaultNoncePoolSize
+		}
+		j.nonces = newNonceManager(j.directoryURL, size)
+		j.nonces.startPrefetcher()
+	})
+
+	if nonce, err := j.nonces.Pop(); err == nil {
 		return nonce, nil
 	}
 
 	return getNonce(j.directoryURL)
 }
 
+// ErrNoNonces is returned by nonceManager.Pop when the pool is currently
+// empty.
+var ErrNoNonces = errors.New("acme: no nonces available in the pool")
+
+// nonceManager pools replay nonces behind a bounded, non-blocking buffered
+// channel. Unlike an unbounded mutex-guarded slice, it can't grow without
+// limit under heavy concurrent issuance, and callers never block on each
+// other to push or pop a nonce.
 type nonceManager struct {
-	nonces []string
-	sync.Mutex
+	directoryURL string
+	pool         chan string
+	stop         chan struct{}
 }
 
-func (n *nonceManager) Pop() (string, bool) {
-	n.Lock()
-	defer n.Unlock()
-
-	if len(n.nonces) == 0 {
-		return "", false
+func newNonceManager(directoryURL string, size int) *nonceManager {
+	return &nonceManager{
+		directoryURL: directoryURL,
+		pool:         make(chan string, size),
 	}
+}
 
-	nonce := n.nonces[len(n.nonces)-1]
-	n.nonces = n.nonces[:len(n.nonces)-1]
-	return nonce, true
+// Pop returns a pooled nonce without blocking, or ErrNoNonces if the pool is
+// currently empty.
+func (n *nonceManager) Pop() (string, error) {
+	select {
+	case nonce := <-n.pool:
+		return nonce, nil
+	default:
+		return "", ErrNoNonces
+	}
 }
 
+// Push adds nonce to the pool without blocking. If the pool is full the
+// nonce is simply dropped, since a fresh one is cheap to fetch on demand.
 func (n *nonceManager) Push(nonce string) {
-	n.Lock()
-	defer n.Unlock()
-	n.nonces = append(n.nonces, nonce)
+	select {
+	case n.pool <- nonce:
+	default:
+	}
+}
+
+// startPrefetcher launches a background goroutine that keeps the pool
+// topped up with HEAD requests to the newNonce endpoint, so issuance
+// goroutines rarely have to fetch a nonce synchronously. The blocking send
+// into pool naturally throttles it to however fast nonces are consumed. A
+// failing endpoint is retried with exponential backoff, capped at
+// nonceRetryMaxDelay, instead of being hammered in a tight loop.
+func (n *nonceManager) startPrefetcher() {
+	n.stop = make(chan struct{})
+
+	go func() {
+		delay := nonceRetryBaseDelay
+
+		for {
+			nonce, err := getNonce(n.directoryURL)
+			if err != nil {
+				select {
+				case <-n.stop:
+					return
+				case <-time.After(delay):
+				}
+
+				if delay *= 2; delay > nonceRetryMaxDelay {
+					delay = nonceRetryMaxDelay
+				}
+				continue
+			}
+			delay = nonceRetryBaseDelay
+
+			select {
+			case n.pool <- nonce:
+			case <-n.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (n *nonceManager) stopPrefetcher() {
+	if n.stop != nil {
+		close(n.stop)
+	}
 }
 
 func getNonce(url string) (string, error) {